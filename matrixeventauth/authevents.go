@@ -0,0 +1,117 @@
+package matrixeventauth
+
+import "fmt"
+
+// stateTuple identifies a single entry of room state by its event type and
+// state key. It is used as the map key for AuthEventsMap.
+type stateTuple struct {
+	EventType string
+	StateKey  string
+}
+
+// AuthEventsMap is a concrete implementation of AuthEvents backed by a map
+// keyed on (type, state_key). It saves callers from having to write their
+// own map-backed provider every time they need to pass state into Allowed.
+type AuthEventsMap struct {
+	events map[stateTuple]*Event
+}
+
+// NewAuthEvents creates an AuthEventsMap populated with the given events.
+// Events that aren't valid auth state (i.e. AddEvent would reject them) are
+// silently skipped.
+func NewAuthEvents(events []Event) *AuthEventsMap {
+	a := &AuthEventsMap{
+		events: make(map[stateTuple]*Event, len(events)),
+	}
+	for _, event := range events {
+		// Ignore the error: NewAuthEvents is a convenience constructor and
+		// callers that care about rejected events should call AddEvent
+		// themselves.
+		_ = a.AddEvent(event)
+	}
+	return a
+}
+
+// AddEvent adds a single state event to the map, routing it by its
+// (Type, StateKey) tuple. It returns an error if the event is not a state
+// event or not one of the types used for auth.
+func (a *AuthEventsMap) AddEvent(e Event) error {
+	tuple, ok := authStateTuple(e)
+	if !ok {
+		return fmt.Errorf("matrixeventauth: event of type %q is not used for auth", e.Type)
+	}
+	if a.events == nil {
+		a.events = map[stateTuple]*Event{}
+	}
+	event := e
+	a.events[tuple] = &event
+	return nil
+}
+
+// Clear removes all events from the map.
+func (a *AuthEventsMap) Clear() {
+	a.events = map[stateTuple]*Event{}
+}
+
+// Events returns the events currently stored in the map, in no particular
+// order.
+func (a *AuthEventsMap) Events() []Event {
+	result := make([]Event, 0, len(a.events))
+	for _, event := range a.events {
+		result = append(result, *event)
+	}
+	return result
+}
+
+func (a *AuthEventsMap) lookup(tuple stateTuple) (*Event, error) {
+	return a.events[tuple], nil
+}
+
+// Create implements AuthEvents.
+func (a *AuthEventsMap) Create() (*Event, error) {
+	return a.lookup(stateTuple{EventType: "m.room.create"})
+}
+
+// JoinRules implements AuthEvents.
+func (a *AuthEventsMap) JoinRules() (*Event, error) {
+	return a.lookup(stateTuple{EventType: "m.room.join_rules"})
+}
+
+// PowerLevels implements AuthEvents.
+func (a *AuthEventsMap) PowerLevels() (*Event, error) {
+	return a.lookup(stateTuple{EventType: "m.room.power_levels"})
+}
+
+// Member implements AuthEvents.
+func (a *AuthEventsMap) Member(stateKey string) (*Event, error) {
+	return a.lookup(stateTuple{EventType: "m.room.member", StateKey: stateKey})
+}
+
+// ThirdPartyInvite implements AuthEvents.
+func (a *AuthEventsMap) ThirdPartyInvite(stateKey string) (*Event, error) {
+	return a.lookup(stateTuple{EventType: "m.room.third_party_invite", StateKey: stateKey})
+}
+
+// Tombstone returns the room's m.room.tombstone event, if any.
+func (a *AuthEventsMap) Tombstone() (*Event, error) {
+	return a.lookup(stateTuple{EventType: "m.room.tombstone"})
+}
+
+// authStateTuple returns the stateTuple an event should be filed under, and
+// whether the event is a state event of a type used for auth at all.
+func authStateTuple(e Event) (stateTuple, bool) {
+	switch e.Type {
+	case "m.room.create", "m.room.join_rules", "m.room.power_levels", "m.room.tombstone":
+		if e.StateKey == nil || *e.StateKey != "" {
+			return stateTuple{}, false
+		}
+		return stateTuple{EventType: e.Type}, true
+	case "m.room.member", "m.room.third_party_invite":
+		if e.StateKey == nil {
+			return stateTuple{}, false
+		}
+		return stateTuple{EventType: e.Type, StateKey: *e.StateKey}, true
+	default:
+		return stateTuple{}, false
+	}
+}
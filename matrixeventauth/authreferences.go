@@ -0,0 +1,91 @@
+package matrixeventauth
+
+import "sort"
+
+// EventReference identifies an event for inclusion in another event's
+// auth_events (or prev_events): the event ID plus, where it can be
+// computed, a SHA-256 hash of its canonical content.
+//
+// Matrix's real reference hash is taken over the redacted canonical JSON
+// of the full event, including its signatures and unsigned data - none of
+// which Event models. EventSHA256 is therefore always nil; it is kept on
+// this struct so callers that do have access to the full event (and its
+// own hashing/redaction logic) have somewhere to attach it, rather than
+// this package fabricating a value that wouldn't match what was actually
+// signed.
+type EventReference struct {
+	EventID     string
+	EventSHA256 []byte
+}
+
+// Reference computes the EventReference for e. See EventReference for why
+// EventSHA256 is left unset.
+func (e Event) Reference() (EventReference, error) {
+	return EventReference{EventID: e.EventID}, nil
+}
+
+// AuthEventReferences resolves the state requested by s to concrete events
+// via provider, returning them as EventReferences in the canonical
+// auth_events order: create, power_levels, join_rules, members (sorted by
+// state_key), then third-party invites (sorted by token). Any slot provider
+// reports as absent (nil, nil) is skipped.
+func (s StateNeeded) AuthEventReferences(provider AuthEvents) ([]EventReference, error) {
+	var refs []EventReference
+
+	addFrom := func(event *Event, err error) error {
+		if err != nil {
+			return err
+		}
+		if event == nil {
+			return nil
+		}
+		ref, err := event.Reference()
+		if err != nil {
+			return err
+		}
+		refs = append(refs, ref)
+		return nil
+	}
+
+	if s.Create {
+		if err := addFrom(provider.Create()); err != nil {
+			return nil, err
+		}
+	}
+	if s.PowerLevels {
+		if err := addFrom(provider.PowerLevels()); err != nil {
+			return nil, err
+		}
+	}
+	if s.JoinRules {
+		if err := addFrom(provider.JoinRules()); err != nil {
+			return nil, err
+		}
+	}
+
+	members := append([]string(nil), s.Member...)
+	sort.Strings(members)
+	for _, stateKey := range members {
+		if err := addFrom(provider.Member(stateKey)); err != nil {
+			return nil, err
+		}
+	}
+
+	invites := append([]string(nil), s.ThirdPartyInvite...)
+	sort.Strings(invites)
+	for _, token := range invites {
+		if err := addFrom(provider.ThirdPartyInvite(token)); err != nil {
+			return nil, err
+		}
+	}
+
+	return refs, nil
+}
+
+// SelectAuthEvents is the common case of AuthEventReferences: it works out
+// the state needed to auth a single new event under room version rv, then
+// resolves that state to EventReferences via provider.
+func SelectAuthEvents(event Event, rv RoomVersion, provider AuthEvents) ([]EventReference, error) {
+	needed := StateNeededForAuth([]Event{event}, rv)
+	return needed.AuthEventReferences(provider)
+}
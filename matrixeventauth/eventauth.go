@@ -13,10 +13,10 @@ type Event struct {
 	EventID    string              `json:"event_id"`
 	Sender     string              `json:"sender"`
 	Type       string              `json:"type"`
-	StateKey   *string             `json:"state_key"`
+	StateKey   *string             `json:"state_key,omitempty"`
 	Content    json.RawMessage     `json:"content"`
-	PrevEvents [][]json.RawMessage `json:"prev_events"`
-	Redacts    string              `json:"redacts"`
+	PrevEvents [][]json.RawMessage `json:"prev_events,omitempty"`
+	Redacts    string              `json:"redacts,omitempty"`
 }
 
 // StateNeeded lists the state entries needed to authenticate an event.
@@ -33,7 +33,9 @@ type StateNeeded struct {
 	ThirdPartyInvite []string
 }
 
-func StateNeededForAuth(events []Event) (result StateNeeded) {
+// StateNeededForAuth returns the state entries needed to authenticate the
+// given events under the rules of room version rv.
+func StateNeededForAuth(events []Event, rv RoomVersion) (result StateNeeded) {
 	var members []string
 	var thirdpartyinvites []string
 
@@ -45,9 +47,18 @@ func StateNeededForAuth(events []Event) (result StateNeeded) {
 			// All other events need the create event.
 			// https://github.com/matrix-org/synapse/blob/v0.18.5/synapse/api/auth.py#L128
 		case "m.room.aliases":
-			// Alias events need no further authentication.
-			// https://github.com/matrix-org/synapse/blob/v0.18.5/synapse/api/auth.py#L160
-			result.Create = true
+			if Rules(rv).Alias != nil {
+				// Pre-v6: alias events need no further authentication.
+				// https://github.com/matrix-org/synapse/blob/v0.18.5/synapse/api/auth.py#L160
+				result.Create = true
+			} else {
+				// v6+: m.room.aliases lost its special case and is authed
+				// by the default rules, like any event type without rules
+				// of its own.
+				result.Create = true
+				result.PowerLevels = true
+				members = append(members, event.Sender)
+			}
 		case "m.room.member":
 			// Member events need the previous membership of the target.
 			// https://github.com/matrix-org/synapse/blob/v0.18.5/synapse/api/auth.py#L355
@@ -62,8 +73,18 @@ func StateNeededForAuth(events []Event) (result StateNeeded) {
 			result.Create = true
 			result.PowerLevels = true
 			result.JoinRules = true
-			members = append(members, event.Sender, event.StateKey)
+			members = append(members, event.Sender)
+			if event.StateKey != nil {
+				members = append(members, *event.StateKey)
+			}
 			thirdpartyinvites = needsThirdpartyInvite(thirdpartyinvites, event)
+			if restrictedJoinRulesAllowed(rv) {
+				// A restricted join names the user who authorised it; we
+				// need that user's membership to check their power level.
+				if authorisedVia, ok := joinAuthorisedViaUsersServer(event); ok {
+					members = append(members, authorisedVia)
+				}
+			}
 		default:
 			// All other events need the membership of the sender.
 			// https://github.com/matrix-org/synapse/blob/v0.18.5/synapse/api/auth.py#L177
@@ -89,6 +110,7 @@ type AuthEvents interface {
 	PowerLevels() (*Event, error)
 	Member(stateKey string) (*Event, error)
 	ThirdPartyInvite(stateKey string) (*Event, error)
+	Tombstone() (*Event, error)
 }
 
 type NotAllowed struct {
@@ -103,24 +125,49 @@ func errorf(message string, args ...interface{}) error {
 	return &NotAllowed{Message: fmt.Sprintf(message, args...)}
 }
 
-func Allowed(event Event, authEvents AuthEvents) error {
+// Allowed checks whether event is allowed by the auth rules of room version
+// rv, given the room state exposed through authEvents.
+func Allowed(event Event, rv RoomVersion, authEvents AuthEvents, verifier SignatureVerifier) error {
+	if err := CheckEventSize(event); err != nil {
+		return err
+	}
+
+	rules := Rules(rv)
 	switch event.Type {
 	case "m.room.create":
-		return createEventAllowed(event, authEvents)
-	case "m.room.alias":
-		return aliasEventAllowed(event, authEvents)
+		return rules.Create(event, authEvents, rv, verifier)
+	case "m.room.aliases":
+		if rules.Alias == nil {
+			return rules.Default(event, authEvents, rv, verifier)
+		}
+		return rules.Alias(event, authEvents, rv, verifier)
 	case "m.room.member":
-		return memberEventAllowed(event, authEvents)
+		return rules.Member(event, authEvents, rv, verifier)
 	case "m.room.power_levels":
-		return powerLevelsEventAllowed(event, authEvents)
+		return rules.PowerLevels(event, authEvents, rv, verifier)
 	case "m.room.redact":
-		return redactEventAllowed(event, authEvents)
+		return rules.Redact(event, authEvents, rv, verifier)
+	case "m.room.tombstone":
+		return rules.Tombstone(event, authEvents, rv, verifier)
 	default:
-		return defaultEventAllowed(event, authEvents)
+		return rules.Default(event, authEvents, rv, verifier)
 	}
 }
 
 func createEventAllowed(event Event, authEvents AuthEvents) error {
+	if len(event.PrevEvents) > 0 {
+		return errorf("create event must be the first event in the room")
+	}
+	return nil
+}
+
+// createEventAllowedV1V2 is the room version 1/2 create check: in those
+// versions an event ID is "$local:domain", so the sender's domain must
+// match the room ID's domain.
+func createEventAllowedV1V2(event Event, authEvents AuthEvents, rv RoomVersion, verifier SignatureVerifier) error {
+	if err := createEventAllowed(event, authEvents); err != nil {
+		return err
+	}
 	roomIDDomain, err := domainFromID(event.RoomID)
 	if err != nil {
 		return err
@@ -132,20 +179,23 @@ func createEventAllowed(event Event, authEvents AuthEvents) error {
 	if senderDomain != roomIDDomain {
 		return errorf("create event room ID domain does not match sender: %q != %q", roomIDDomain, senderDomain)
 	}
-	if len(event.PrevEvents) > 0 {
-		return errorf("create event must be the first event in the room")
-	}
 	return nil
 }
 
-func aliasEventAllowed(event Event, authEvents AuthEvents) error {
+// createEventAllowedV3Plus is the room version 3+ create check. From
+// version 3 onwards event IDs are content hashes, and the v1/v2 check that
+// the sender's domain matches the room ID's domain is not applied.
+func createEventAllowedV3Plus(event Event, authEvents AuthEvents, rv RoomVersion, verifier SignatureVerifier) error {
+	return createEventAllowed(event, authEvents)
+}
+
+func aliasEventAllowed(event Event, authEvents AuthEvents, rv RoomVersion, verifier SignatureVerifier) error {
 	var create createContent
 	senderDomain, err := domainFromID(event.Sender)
 	if err != nil {
 		return err
 	}
-	create, err := createEvent(authEvents)
-	if err != nil {
+	if err := create.load(authEvents); err != nil {
 		return err
 	}
 	if err := create.domainAllowed(senderDomain); err != nil {
@@ -160,7 +210,7 @@ func aliasEventAllowed(event Event, authEvents AuthEvents) error {
 	return nil
 }
 
-func memberEventAllowed(event Event, authEvents AuthEvents) error {
+func memberEventAllowed(event Event, authEvents AuthEvents, rv RoomVersion, verifier SignatureVerifier) error {
 	var create createContent
 	var newMember memberContent
 	if err := create.load(authEvents); err != nil {
@@ -187,7 +237,7 @@ func memberEventAllowed(event Event, authEvents AuthEvents) error {
 			return errorf("unparsable prev event")
 		}
 		var prevEventID string
-		if err := json.Unmarshal(PrevEvents[0][0], &prevEventID); err != nil {
+		if err := json.Unmarshal(event.PrevEvents[0][0], &prevEventID); err != nil {
 			return errorf("unparsable prev event")
 		}
 		if prevEventID == create.eventID {
@@ -202,42 +252,51 @@ func memberEventAllowed(event Event, authEvents AuthEvents) error {
 		return err
 	}
 
-	if newMembership == "invite" && thirdPartyInvite != nil {
-		// Special case third party invites
+	if newMember.Membership == "invite" && len(needsThirdpartyInvite(nil, event)) > 0 {
+		// Special case third party invites.
 		// https://github.com/matrix-org/synapse/blob/v0.18.5/synapse/api/auth.py#L393
-		panic(fmt.Errorf("ThirdPartyInvite not implemented"))
-
-		// Otherwise fall through to the usual authentication process.
+		if err := thirdPartyInviteEventAllowed(event, authEvents, verifier); err != nil {
+			return err
+		}
+		// The signature checked out; fall through to the usual membership
+		// authentication process, which still requires the sender to hold
+		// enough power to invite.
 	}
 
 	var m membershipAllower
-	if err = m.setup(&event, authEvents); err != nil {
+	if err := m.setup(&event, authEvents, rv); err != nil {
 		return err
 	}
 	return m.membershipAllowed()
 }
 
 type membershipAllower struct {
-	targetID     string
-	senderID     string
-	senderMember memberContent
-	oldMember    memberContent
-	newMember    memberContent
-	joinRule     joinRuleContent
-	create       createContent
-	powerLevels  powerLevelContent
+	rv             RoomVersion
+	targetID       string
+	senderID       string
+	senderMember   memberContent
+	oldMember      memberContent
+	newMember      memberContent
+	newMemberEvent Event
+	joinRule       joinRuleContent
+	create         createContent
+	powerLevels    powerLevelContent
+	authEvents     AuthEvents
 }
 
-func (m *membershipAllower) setup(event *Event, authEvents AuthEvents) error {
+func (m *membershipAllower) setup(event *Event, authEvents AuthEvents, rv RoomVersion) error {
+	m.rv = rv
+	m.authEvents = authEvents
 	m.targetID = *event.StateKey
 	m.senderID = event.Sender
-	if err := m.senderMembership.load(authEvents, m.senderID); err != nil {
+	m.newMemberEvent = *event
+	if err := m.senderMember.load(authEvents, m.senderID); err != nil {
 		return err
 	}
-	if err := m.oldMembership.load(authEvents, m.targetID); err != nil {
+	if err := m.oldMember.load(authEvents, m.targetID); err != nil {
 		return err
 	}
-	if err := m.newMembership.parse(event); err != nil {
+	if err := m.newMember.parse(event); err != nil {
 		return err
 	}
 	if err := m.create.load(authEvents); err != nil {
@@ -254,7 +313,7 @@ func (m *membershipAllower) setup(event *Event, authEvents AuthEvents) error {
 
 // membershipAllowed determines whether the membership change is allowed.
 func (m *membershipAllower) membershipAllowed() error {
-	if m.targetID == m.SenderID {
+	if m.targetID == m.senderID {
 		return m.membershipAllowedSelf()
 	}
 	return m.membershipAllowedOther()
@@ -279,6 +338,21 @@ func (m *membershipAllower) membershipAllowedSelf() error {
 		if m.oldMember.Membership == "join" {
 			return nil
 		}
+		// v8+: a restricted room (or, from v10, a knock_restricted room)
+		// lets a user join directly, same as "public", provided the join
+		// was authorised by someone with enough power to invite.
+		if restrictedJoinRulesAllowed(m.rv) &&
+			(m.joinRule.JoinRule == "restricted" ||
+				(m.joinRule.JoinRule == "knock_restricted" && m.rv == RoomVersionV10)) &&
+			(m.oldMember.Membership == "leave" || m.oldMember.Membership == "invite" || m.oldMember.Membership == "knock") {
+			authorised, err := m.restrictedJoinAuthorised()
+			if err != nil {
+				return err
+			}
+			if authorised {
+				return nil
+			}
+		}
 	}
 	if m.newMember.Membership == "leave" {
 		// A joined user is allowed to leave the room.
@@ -289,13 +363,51 @@ func (m *membershipAllower) membershipAllowedSelf() error {
 		if m.oldMember.Membership == "invite" {
 			return nil
 		}
+		// v7+: a user who knocked is allowed to rescind the knock.
+		if knockingAllowed(m.rv) && m.oldMember.Membership == "knock" {
+			return nil
+		}
+	}
+	if m.newMember.Membership == "knock" && knockingAllowed(m.rv) {
+		// A user that isn't in the room is allowed to knock if the join
+		// rules allow it.
+		if m.oldMember.Membership == "leave" &&
+			(m.joinRule.JoinRule == "knock" ||
+				(m.joinRule.JoinRule == "knock_restricted" && m.rv == RoomVersionV10)) {
+			return nil
+		}
 	}
 	return m.membershipFailed()
 }
 
+// restrictedJoinAuthorised checks the join_authorised_via_users_server
+// named in the new member event: per MSC3083 it must be a user who is
+// currently joined to the room and who holds enough power to invite.
+//
+// This reuses joinAuthorisedViaUsersServer, the same helper
+// StateNeededForAuth uses to decide which member state to pull in, so the
+// two can't disagree about which user the event names as authoriser.
+func (m *membershipAllower) restrictedJoinAuthorised() (bool, error) {
+	authoriser, ok := joinAuthorisedViaUsersServer(m.newMemberEvent)
+	if !ok {
+		return false, nil
+	}
+
+	var authoriserMember memberContent
+	if err := authoriserMember.load(m.authEvents, authoriser); err != nil {
+		return false, err
+	}
+	if authoriserMember.Membership != "join" {
+		return false, nil
+	}
+
+	senderLevel := m.powerLevels.userLevel(authoriser)
+	return senderLevel >= m.powerLevels.inviteLevel, nil
+}
+
 func (m *membershipAllower) membershipAllowedOther() error {
-	senderLevel := m.powerLevels.userLevel(m.SenderID)
-	targetLevel := m.powerLevels.userLevel(m.TargetID)
+	senderLevel := m.powerLevels.userLevel(m.senderID)
+	targetLevel := m.powerLevels.userLevel(m.targetID)
 
 	// You may only modify the membership of another user if you are in the room.
 	if m.senderMember.Membership == "join" {
@@ -308,15 +420,21 @@ func (m *membershipAllower) membershipAllowedOther() error {
 		}
 		if m.newMember.Membership == "leave" {
 			// A user may unban another user if their level is high enough.
-			if m.oldMembership == "ban" && senderLevel >= powerLevels.banLevel {
+			if m.oldMember.Membership == "ban" && senderLevel >= m.powerLevels.banLevel {
 				return nil
 			}
 			// A user may kick another user if their level is high enough.
 			if m.oldMember.Membership != "ban" &&
-				senderLevel >= powerLevels.kickLevel &&
+				senderLevel >= m.powerLevels.kickLevel &&
 				senderLevel > targetLevel {
 				return nil
 			}
+			// v7+: a user may reject another user's knock if their level is
+			// high enough.
+			if knockingAllowed(m.rv) && m.oldMember.Membership == "knock" &&
+				senderLevel >= m.powerLevels.kickLevel {
+				return nil
+			}
 		}
 		if m.newMember.Membership == "invite" {
 			// A user may invite another user if the user has left the room.
@@ -328,6 +446,12 @@ func (m *membershipAllower) membershipAllowedOther() error {
 			if m.oldMember.Membership == "invite" && senderLevel >= m.powerLevels.inviteLevel {
 				return nil
 			}
+			// v7+: a user may invite another user who has knocked, if their
+			// level is high enough.
+			if knockingAllowed(m.rv) && m.oldMember.Membership == "knock" &&
+				senderLevel >= m.powerLevels.inviteLevel {
+				return nil
+			}
 		}
 	}
 
@@ -353,16 +477,16 @@ func (m *membershipAllower) membershipFailed() error {
 	)
 }
 
-func powerLevelEventAllowed(event Event, authEvents AuthEvents) error {
+func powerLevelsEventAllowed(event Event, authEvents AuthEvents, rv RoomVersion, verifier SignatureVerifier) error {
 	var allower eventAllower
-	if err := allower.setup(authEvents); err != nil {
+	if err := allower.setup(authEvents, event.Sender); err != nil {
 		return err
 	}
-	if err := allower.commonChecks(); err != nil {
+	if err := allower.commonChecks(event); err != nil {
 		return err
 	}
 
-	oldPowerLevels := allower.powerlevels
+	oldPowerLevels := allower.powerLevels
 	var newPowerLevels powerLevelContent
 	if err := newPowerLevels.parse(&event); err != nil {
 		return err
@@ -370,10 +494,12 @@ func powerLevelEventAllowed(event Event, authEvents AuthEvents) error {
 
 	for userID := range newPowerLevels.userLevels {
 		if !isValidUserID(userID) {
-			return errorf("Not a valid user ID: %q", userID)
+			return errorf("not a valid user ID: %q", userID)
 		}
 	}
 
+	senderLevel := oldPowerLevels.userLevel(event.Sender)
+
 	type levelPair struct {
 		old int64
 		new int64
@@ -389,13 +515,12 @@ func powerLevelEventAllowed(event Event, authEvents AuthEvents) error {
 	}
 
 	for eventType := range newPowerLevels.eventLevels {
-		levelChecks := append(levelChecks, levelPair{
+		levelChecks = append(levelChecks, levelPair{
 			oldPowerLevels.eventLevel(eventType, nil), newPowerLevels.eventLevel(eventType, nil),
 		})
 	}
-
 	for eventType := range oldPowerLevels.eventLevels {
-		levelChecks := append(levelChecks, levelPair{
+		levelChecks = append(levelChecks, levelPair{
 			oldPowerLevels.eventLevel(eventType, nil), newPowerLevels.eventLevel(eventType, nil),
 		})
 	}
@@ -414,20 +539,22 @@ func powerLevelEventAllowed(event Event, authEvents AuthEvents) error {
 	userLevelChecks := []levelPair{
 		{oldPowerLevels.userDefaultLevel, newPowerLevels.userDefaultLevel},
 	}
-
 	for userID := range newPowerLevels.userLevels {
-		userLevelChecks := append(levelChecks, levelPair{
+		userLevelChecks = append(userLevelChecks, levelPair{
 			oldPowerLevels.userLevel(userID), newPowerLevels.userLevel(userID),
 		})
 	}
-
-	for userID := range newPowerLevels.userLevels {
-		userLevelChecks := append(levelChecks, levelPair{
+	for userID := range oldPowerLevels.userLevels {
+		if _, ok := newPowerLevels.userLevels[userID]; ok {
+			// Already covered by the loop above.
+			continue
+		}
+		userLevelChecks = append(userLevelChecks, levelPair{
 			oldPowerLevels.userLevel(userID), newPowerLevels.userLevel(userID),
 		})
 	}
 
-	for _, level := range levelChecks {
+	for _, level := range userLevelChecks {
 		if level.old != level.new {
 			if senderLevel <= level.old || senderLevel < level.new {
 				return errorf(
@@ -441,17 +568,63 @@ func powerLevelEventAllowed(event Event, authEvents AuthEvents) error {
 	return nil
 }
 
+// powerLevelsEventAllowedV6Plus runs the ordinary power level checks and
+// additionally validates the "notifications" sub-key introduced for v6:
+// each entry in it is subject to the same level-change rule as any other
+// power level.
+// https://spec.matrix.org/v1.9/rooms/v6/#notifications
+func powerLevelsEventAllowedV6Plus(event Event, authEvents AuthEvents, rv RoomVersion, verifier SignatureVerifier) error {
+	if err := powerLevelsEventAllowed(event, authEvents, rv, verifier); err != nil {
+		return err
+	}
+
+	var allower eventAllower
+	if err := allower.setup(authEvents, event.Sender); err != nil {
+		return err
+	}
+	senderLevel := allower.powerLevels.userLevel(event.Sender)
+	oldNotifications := allower.powerLevels.notificationLevels
+
+	var newPowerLevels powerLevelContent
+	if err := newPowerLevels.parse(&event); err != nil {
+		return err
+	}
+	newNotifications := newPowerLevels.notificationLevels
+
+	seen := map[string]bool{}
+	for key := range oldNotifications {
+		seen[key] = true
+	}
+	for key := range newNotifications {
+		seen[key] = true
+	}
+	for key := range seen {
+		oldLevel := oldNotifications[key]
+		newLevel := newNotifications[key]
+		if oldLevel != newLevel {
+			if senderLevel < oldLevel || senderLevel < newLevel {
+				return errorf(
+					"sender with level %d is not allowed to change notifications.%s level from %d to %d",
+					senderLevel, key, oldLevel, newLevel,
+				)
+			}
+		}
+	}
+
+	return nil
+}
+
 func isValidUserID(userID string) bool {
-	return userID[0] == '@' && strings.IndexByte(userID, ':') != -1
+	return len(userID) > 0 && userID[0] == '@' && strings.IndexByte(userID, ':') != -1
 }
 
-func redactEventAllowed(event Event, authEvents AuthEvents) error {
+func redactEventAllowed(event Event, authEvents AuthEvents, rv RoomVersion, verifier SignatureVerifier) error {
 	var allower eventAllower
 	if err := allower.setup(authEvents, event.Sender); err != nil {
 		return err
 	}
 
-	if err := allower.commonChecks(); err != nil {
+	if err := allower.commonChecks(event); err != nil {
 		return err
 	}
 
@@ -470,8 +643,8 @@ func redactEventAllowed(event Event, authEvents AuthEvents) error {
 		return nil
 	}
 
-	senderLevel = allower.powerlevels.userLevel(event.Sender)
-	redactLevel = allower.powerlevels.redactLevel
+	senderLevel := allower.powerLevels.userLevel(event.Sender)
+	redactLevel := allower.powerLevels.redactLevel
 
 	// Otherwise the sender must have enough power.
 	if senderLevel >= redactLevel {
@@ -479,24 +652,24 @@ func redactEventAllowed(event Event, authEvents AuthEvents) error {
 	}
 
 	return errorf(
-		"%q is not allowed to react message from %q. %d < %d",
+		"%q is not allowed to redact message from %q. %d < %d",
 		event.Sender, redactDomain, senderLevel, redactLevel,
 	)
 }
 
-func defaultEventAllowed(event Event, authEvents AuthEvents) error {
+func defaultEventAllowed(event Event, authEvents AuthEvents, rv RoomVersion, verifier SignatureVerifier) error {
 	var allower eventAllower
 	if err := allower.setup(authEvents, event.Sender); err != nil {
 		return err
 	}
 
-	return allower.commonChecks()
+	return allower.commonChecks(event)
 }
 
 type eventAllower struct {
 	create      createContent
 	member      memberContent
-	powerlevels powerLevelContent
+	powerLevels powerLevelContent
 }
 
 func (e *eventAllower) setup(authEvents AuthEvents, senderID string) error {
@@ -512,13 +685,17 @@ func (e *eventAllower) setup(authEvents AuthEvents, senderID string) error {
 	return nil
 }
 
-func (e *eventAllower) defaultAllowed(event Event, authEvents AuthEvents) error {
+// commonChecks is the generic gate shared by every event type that doesn't
+// have event-type-specific rules of its own: the sender must be joined, and
+// must hold enough power to send an event of this type (and, for state
+// events, to modify this particular state_key).
+func (e *eventAllower) commonChecks(event Event) error {
 	if err := e.create.idAllowed(event.Sender); err != nil {
 		return err
 	}
 
 	if e.member.Membership != "join" {
-		return errof("sender %q not in room", event.Sender)
+		return errorf("sender %q not in room", event.Sender)
 	}
 
 	senderLevel := e.powerLevels.userLevel(event.Sender)
@@ -530,7 +707,7 @@ func (e *eventAllower) defaultAllowed(event Event, authEvents AuthEvents) error
 		)
 	}
 
-	if event.StateKey != nil && len(event.StateKey) > 0 && event.StateKey[0] == "@" {
+	if event.StateKey != nil && len(*event.StateKey) > 0 && (*event.StateKey)[0] == '@' {
 		if *event.StateKey != event.Sender {
 			return errorf(
 				"sender %q is not allowed to modify the state belonging to %q",
@@ -581,4 +758,21 @@ func needsThirdpartyInvite(thirdpartyinvites []string, event Event) []string {
 	}
 
 	return thirdpartyinvites
-}
\ No newline at end of file
+}
+
+// joinAuthorisedViaUsersServer extracts the join_authorised_via_users_server
+// field from a "join" membership event's content, as used by restricted
+// join rules (room version 8+).
+func joinAuthorisedViaUsersServer(event Event) (string, bool) {
+	var content struct {
+		Membership    string `json:"membership"`
+		AuthorisedVia string `json:"join_authorised_via_users_server"`
+	}
+	if err := json.Unmarshal(event.Content, &content); err != nil {
+		return "", false
+	}
+	if content.Membership != "join" || content.AuthorisedVia == "" {
+		return "", false
+	}
+	return content.AuthorisedVia, true
+}
@@ -0,0 +1,83 @@
+package matrixeventauth
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+)
+
+// Size limits enforced by CheckEventSize, matching Synapse's
+// _check_size_limits.
+// https://github.com/matrix-org/synapse/blob/v1.60.0/synapse/event_auth.py
+const (
+	// MaxIDLength is the maximum length, in bytes, of an event's sender,
+	// type, event_id, room_id or state_key.
+	MaxIDLength = 255
+	// MaxEventLength is the maximum length, in bytes, of an event's
+	// canonical JSON serialization.
+	MaxEventLength = 65536
+)
+
+// EventSizeError is returned by CheckEventSize. It is distinct from
+// NotAllowed so that servers can tell an oversized event (M_TOO_LARGE) apart
+// from an ordinary auth failure.
+type EventSizeError struct {
+	Message string
+}
+
+func (e *EventSizeError) Error() string {
+	return "matrixeventauth: " + e.Message
+}
+
+func sizeErrorf(message string, args ...interface{}) error {
+	return &EventSizeError{Message: fmt.Sprintf(message, args...)}
+}
+
+// CheckEventSize enforces the event size limits Synapse applies before
+// running the auth rules: the sender, type, event_id, room_id and
+// state_key must each fit within MaxIDLength bytes, and the event's
+// canonical JSON serialization must fit within MaxEventLength bytes.
+func CheckEventSize(event Event) error {
+	if len(event.Sender) > MaxIDLength {
+		return sizeErrorf("sender is longer than %d bytes", MaxIDLength)
+	}
+	if len(event.Type) > MaxIDLength {
+		return sizeErrorf("type is longer than %d bytes", MaxIDLength)
+	}
+	if len(event.EventID) > MaxIDLength {
+		return sizeErrorf("event_id is longer than %d bytes", MaxIDLength)
+	}
+	if len(event.RoomID) > MaxIDLength {
+		return sizeErrorf("room_id is longer than %d bytes", MaxIDLength)
+	}
+	if event.StateKey != nil && len(*event.StateKey) > MaxIDLength {
+		return sizeErrorf("state_key is longer than %d bytes", MaxIDLength)
+	}
+
+	raw, err := canonicalJSON(event)
+	if err != nil {
+		return err
+	}
+	if len(raw) > MaxEventLength {
+		return sizeErrorf("event is larger than %d bytes", MaxEventLength)
+	}
+
+	return nil
+}
+
+// canonicalJSON encodes v without HTML-escaping '<', '>' and '&', which
+// Matrix canonical JSON doesn't do but encoding/json's Marshal does by
+// default. Event's "omitempty" tags take care of the rest: fields absent
+// from the real event (state_key, prev_events, redacts) are left out
+// rather than serialized as their Go zero value, matching what actually
+// goes over the wire closely enough for a size check.
+func canonicalJSON(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	// Encoder.Encode appends a trailing newline; canonical JSON has none.
+	return bytes.TrimRight(buf.Bytes(), "\n"), nil
+}
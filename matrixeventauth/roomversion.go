@@ -0,0 +1,148 @@
+package matrixeventauth
+
+// RoomVersion describes the version of a room, as specified in the room's
+// m.room.create event. The auth rules that apply to a room can change
+// between versions, so most of the per-event-type checks are looked up
+// through a RuleSet for the room's version rather than being hard-coded.
+// https://matrix.org/docs/spec/#room-versions
+type RoomVersion string
+
+// The room versions understood by this package.
+const (
+	RoomVersionV1  RoomVersion = "1"
+	RoomVersionV2  RoomVersion = "2"
+	RoomVersionV3  RoomVersion = "3"
+	RoomVersionV4  RoomVersion = "4"
+	RoomVersionV5  RoomVersion = "5"
+	RoomVersionV6  RoomVersion = "6"
+	RoomVersionV7  RoomVersion = "7"
+	RoomVersionV8  RoomVersion = "8"
+	RoomVersionV9  RoomVersion = "9"
+	RoomVersionV10 RoomVersion = "10"
+)
+
+// eventAllowedFunc is the shape shared by every per-event-type auth check.
+// rv is passed through so a check can consult version-specific behaviour
+// that doesn't warrant its own RuleSet field. verifier is only consulted by
+// the member check, for third-party invites, but is threaded through all of
+// them for uniformity.
+type eventAllowedFunc func(event Event, authEvents AuthEvents, rv RoomVersion, verifier SignatureVerifier) error
+
+// RuleSet is the set of auth checks that apply to a given room version. A
+// nil field means the room version has no special-case check for that event
+// type; callers should fall back to Default.
+type RuleSet struct {
+	Create      eventAllowedFunc
+	Alias       eventAllowedFunc
+	Member      eventAllowedFunc
+	PowerLevels eventAllowedFunc
+	Redact      eventAllowedFunc
+	Tombstone   eventAllowedFunc
+	Default     eventAllowedFunc
+}
+
+// v1Rules is the baseline rule set that later room versions patch.
+var v1Rules = RuleSet{
+	Create:      createEventAllowedV1V2,
+	Alias:       aliasEventAllowed,
+	Member:      memberEventAllowed,
+	PowerLevels: powerLevelsEventAllowed,
+	Redact:      redactEventAllowed,
+	Tombstone:   tombstoneEventAllowed,
+	Default:     defaultEventAllowed,
+}
+
+// v2Rules: room version 2 changed state resolution, not the auth rules
+// themselves.
+var v2Rules = v1Rules
+
+// v3Rules: from v3 onwards event IDs are content hashes rather than
+// "$localpart:domain", so the create event's sender/room-ID domain
+// comparison no longer applies.
+var v3Rules = withRules(v2Rules, func(r *RuleSet) {
+	r.Create = createEventAllowedV3Plus
+})
+
+// v4Rules, v5Rules: event ID format and redaction algorithm changes that
+// don't affect these auth rules.
+var v4Rules = v3Rules
+var v5Rules = v4Rules
+
+// v6Rules: m.room.aliases stops being a special-cased auth event, and
+// m.room.power_levels gains validation of the notifications sub-key.
+var v6Rules = withRules(v5Rules, func(r *RuleSet) {
+	r.Alias = nil
+	r.PowerLevels = powerLevelsEventAllowedV6Plus
+})
+
+// v7Rules: adds the knock membership, and the leave<->knock transitions
+// that go with it. memberEventAllowed itself consults knockingAllowed(rv),
+// so no new function pointer is needed here.
+var v7Rules = v6Rules
+
+// v8Rules, v9Rules: the restricted join rule, under which a user may join
+// directly when the join names (in join_authorised_via_users_server) a
+// joined user with enough power to invite; the join rule's allow list is
+// not consulted. Again memberEventAllowed branches on
+// restrictedJoinRulesAllowed(rv) itself.
+var v8Rules = v7Rules
+var v9Rules = v8Rules
+
+// v10Rules: adds the knock_restricted join rule, which combines the knock
+// and restricted behaviours above. memberEventAllowed checks for room
+// version 10 itself, so no new function pointer is needed here.
+var v10Rules = v9Rules
+
+var ruleSets = map[RoomVersion]RuleSet{
+	RoomVersionV1:  v1Rules,
+	RoomVersionV2:  v2Rules,
+	RoomVersionV3:  v3Rules,
+	RoomVersionV4:  v4Rules,
+	RoomVersionV5:  v5Rules,
+	RoomVersionV6:  v6Rules,
+	RoomVersionV7:  v7Rules,
+	RoomVersionV8:  v8Rules,
+	RoomVersionV9:  v9Rules,
+	RoomVersionV10: v10Rules,
+}
+
+// Rules returns the RuleSet for the given room version, falling back to the
+// version 1 rules for an unrecognised version so that callers always get a
+// usable (if conservative) set of checks.
+func Rules(rv RoomVersion) RuleSet {
+	if rules, ok := ruleSets[rv]; ok {
+		return rules
+	}
+	return v1Rules
+}
+
+// withRules copies base and applies patch to the copy, so that later room
+// versions can be expressed as a small delta on an earlier one.
+func withRules(base RuleSet, patch func(*RuleSet)) RuleSet {
+	rules := base
+	patch(&rules)
+	return rules
+}
+
+// restrictedJoinRulesAllowed reports whether rv supports the "restricted"
+// join rule introduced in room version 8. The "knock_restricted" join rule
+// additionally requires room version 10.
+func restrictedJoinRulesAllowed(rv RoomVersion) bool {
+	switch rv {
+	case RoomVersionV8, RoomVersionV9, RoomVersionV10:
+		return true
+	default:
+		return false
+	}
+}
+
+// knockingAllowed reports whether rv supports the "knock" membership
+// introduced in room version 7.
+func knockingAllowed(rv RoomVersion) bool {
+	switch rv {
+	case RoomVersionV7, RoomVersionV8, RoomVersionV9, RoomVersionV10:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,78 @@
+package matrixeventauth
+
+import "encoding/json"
+
+// tombstoneContent is the content of an m.room.tombstone event, sent when a
+// room is upgraded to a new room version.
+type tombstoneContent struct {
+	ReplacementRoom string `json:"replacement_room"`
+	Body            string `json:"body"`
+}
+
+// tombstoneEventAllowed checks an m.room.tombstone event. It's authorised
+// like any other state event (the sender needs state_default power), plus
+// its own field validation. Sending a tombstone doesn't change how any
+// other event in the room is authorised - that's left to IsTombstoned,
+// which callers consult explicitly when they want to follow a room
+// upgrade.
+func tombstoneEventAllowed(event Event, authEvents AuthEvents, rv RoomVersion, verifier SignatureVerifier) error {
+	var allower eventAllower
+	if err := allower.setup(authEvents, event.Sender); err != nil {
+		return err
+	}
+	if err := allower.commonChecks(event); err != nil {
+		return err
+	}
+
+	if event.StateKey == nil || *event.StateKey != "" {
+		return errorf("m.room.tombstone must have an empty state_key")
+	}
+
+	var content tombstoneContent
+	if err := json.Unmarshal(event.Content, &content); err != nil {
+		return errorf("unparsable m.room.tombstone content: %v", err)
+	}
+	if content.ReplacementRoom == "" {
+		return errorf("m.room.tombstone is missing replacement_room")
+	}
+
+	replacementDomain, err := domainFromID(content.ReplacementRoom)
+	if err != nil {
+		return errorf("replacement_room is not a valid room ID: %v", err)
+	}
+	senderDomain, err := domainFromID(event.Sender)
+	if err != nil {
+		return err
+	}
+	if replacementDomain != senderDomain {
+		return errorf(
+			"replacement_room domain does not match sender: %q != %q",
+			replacementDomain, senderDomain,
+		)
+	}
+
+	return nil
+}
+
+// IsTombstoned reports whether the room has been tombstoned (upgraded),
+// and if so the room ID it was replaced by. Callers such as room upgrade
+// flows use this to detect and follow the replacement.
+func IsTombstoned(authEvents AuthEvents) (replacement string, ok bool, err error) {
+	event, err := authEvents.Tombstone()
+	if err != nil {
+		return "", false, err
+	}
+	if event == nil {
+		return "", false, nil
+	}
+
+	var content tombstoneContent
+	if err := json.Unmarshal(event.Content, &content); err != nil {
+		return "", false, err
+	}
+	if content.ReplacementRoom == "" {
+		return "", false, nil
+	}
+
+	return content.ReplacementRoom, true, nil
+}